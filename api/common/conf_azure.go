@@ -16,23 +16,170 @@ package common
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/Azure/go-autorest/autorest"
-	"github.com/Azure/go-autorest/autorest/adal"
-	"github.com/Azure/go-autorest/autorest/azure"
-	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
 	"github.com/Azure/go-autorest/autorest/azure/cli"
 
-	azblob "github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-04-01/storage"
 	"github.com/mitchellh/go-homedir"
 	ini "gopkg.in/ini.v1"
 )
 
+// defaultTokenRenewBuffer matches AZBlobConfig.Init()'s TokenRenewBuffer:
+// how far ahead of expiry a cached token is proactively refreshed.
+const defaultTokenRenewBuffer = 15 * time.Minute
+
+// storageResourceID is the AAD resource/audience for Azure Storage's data
+// plane. Unlike ARM, it's the same logical identifier across the public,
+// government, and China clouds.
+const storageResourceID = "https://storage.azure.com/"
+
+// AzureCloudEnvironment describes the storage DNS suffix and ARM/AAD
+// endpoints for one Azure cloud (public, a sovereign cloud, or a custom
+// Azure Stack Hub instance), replacing go-autorest's azure.Environment.
+type AzureCloudEnvironment struct {
+	Name                  string
+	StorageEndpointSuffix string
+	ARM                   cloud.Configuration
+}
+
+var (
+	AzurePublicCloud = AzureCloudEnvironment{
+		Name:                  "AzurePublicCloud",
+		StorageEndpointSuffix: "core.windows.net",
+		ARM:                   cloud.AzurePublic,
+	}
+	AzureUSGovernmentCloud = AzureCloudEnvironment{
+		Name:                  "AzureUSGovernmentCloud",
+		StorageEndpointSuffix: "core.usgovcloudapi.net",
+		ARM:                   cloud.AzureGovernment,
+	}
+	AzureChinaCloud = AzureCloudEnvironment{
+		Name:                  "AzureChinaCloud",
+		StorageEndpointSuffix: "core.chinacloudapi.cn",
+		ARM:                   cloud.AzureChina,
+	}
+	// AzureGermanCloud predates azcore's cloud package (which only ships
+	// public/government/china), so its ARM/AAD endpoints are declared
+	// here by hand.
+	AzureGermanCloud = AzureCloudEnvironment{
+		Name:                  "AzureGermanCloud",
+		StorageEndpointSuffix: "core.cloudapi.de",
+		ARM: cloud.Configuration{
+			ActiveDirectoryAuthorityHost: "https://login.microsoftonline.de/",
+			Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+				cloud.ResourceManager: {
+					Endpoint: "https://management.microsoftazure.de",
+					Audience: "https://management.microsoftazure.de",
+				},
+			},
+		},
+	}
+)
+
+// azureEnvironment resolves the Azure cloud to use from an explicit
+// --az-cloud value, falling back to AZURE_ENVIRONMENT, and defaulting to
+// the public cloud. One of the well-known names (AzurePublicCloud,
+// AzureUSGovernmentCloud, AzureChinaCloud, AzureGermanCloud) selects a
+// built-in; a value starting with http:// or https:// is treated as the
+// resource manager endpoint of a custom Azure Stack Hub stamp and resolved
+// via its metadata endpoint. Any other value is an error.
+func azureEnvironment(cloudName string) (AzureCloudEnvironment, error) {
+	if cloudName == "" {
+		cloudName = os.Getenv("AZURE_ENVIRONMENT")
+	}
+
+	switch cloudName {
+	case "", AzurePublicCloud.Name:
+		return AzurePublicCloud, nil
+	case AzureUSGovernmentCloud.Name:
+		return AzureUSGovernmentCloud, nil
+	case AzureChinaCloud.Name:
+		return AzureChinaCloud, nil
+	case AzureGermanCloud.Name:
+		return AzureGermanCloud, nil
+	}
+
+	if strings.HasPrefix(cloudName, "http://") || strings.HasPrefix(cloudName, "https://") {
+		return azureStackEnvironment(cloudName)
+	}
+
+	return AzureCloudEnvironment{}, fmt.Errorf("unknown Azure environment: %v", cloudName)
+}
+
+// azureStackMetadata is the subset of an Azure Stack Hub
+// /metadata/endpoints response this package needs.
+type azureStackMetadata struct {
+	Authentication struct {
+		LoginEndpoint string   `json:"loginEndpoint"`
+		Audiences     []string `json:"audiences"`
+	} `json:"authentication"`
+	Suffixes struct {
+		Storage string `json:"storage"`
+	} `json:"suffixes"`
+}
+
+// azureStackMetadataTimeout bounds the Azure Stack Hub metadata lookup so
+// an unreachable or slow custom endpoint can't hang AzureBlobConfig (and
+// thus the mount) indefinitely.
+const azureStackMetadataTimeout = 30 * time.Second
+
+// azureStackEnvironment discovers a custom stack's endpoints by querying
+// its resource manager's metadata endpoint, the same discovery mechanism
+// az cli and the Azure Stack Hub SDKs use.
+func azureStackEnvironment(armEndpoint string) (AzureCloudEnvironment, error) {
+	metadataURL := strings.TrimRight(armEndpoint, "/") + "/metadata/endpoints?api-version=2015-01-01"
+
+	client := &http.Client{Timeout: azureStackMetadataTimeout}
+	resp, err := client.Get(metadataURL)
+	if err != nil {
+		return AzureCloudEnvironment{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return AzureCloudEnvironment{}, fmt.Errorf("fetching %v: unexpected status %v",
+			metadataURL, resp.Status)
+	}
+
+	var md azureStackMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&md); err != nil {
+		return AzureCloudEnvironment{}, fmt.Errorf("parsing %v: %v", metadataURL, err)
+	}
+
+	audience := armEndpoint
+	if len(md.Authentication.Audiences) > 0 {
+		audience = md.Authentication.Audiences[0]
+	}
+
+	return AzureCloudEnvironment{
+		Name:                  armEndpoint,
+		StorageEndpointSuffix: md.Suffixes.Storage,
+		ARM: cloud.Configuration{
+			ActiveDirectoryAuthorityHost: md.Authentication.LoginEndpoint,
+			Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+				cloud.ResourceManager: {
+					Endpoint: armEndpoint,
+					Audience: audience,
+				},
+			},
+		},
+	}, nil
+}
+
 type SASTokenProvider func() (string, error)
 
 type AZBlobConfig struct {
@@ -40,6 +187,7 @@ type AZBlobConfig struct {
 	AccountName      string
 	AccountKey       string
 	SasToken         SASTokenProvider
+	Credential       azcore.TokenCredential
 	TokenRenewBuffer time.Duration
 
 	Container string
@@ -47,141 +195,305 @@ type AZBlobConfig struct {
 }
 
 func (config *AZBlobConfig) Init() {
-	config.TokenRenewBuffer = 15 * time.Minute
+	config.TokenRenewBuffer = defaultTokenRenewBuffer
 }
 
 type ADLv1Config struct {
-	Endpoint   string
-	Authorizer autorest.Authorizer
+	Endpoint string
+	// Credential is set by a caller that builds this config directly, for
+	// data-plane-only AAD principals that can't fall back to an account
+	// key. Unlike AZBlobConfig.Credential, nothing in this package fills
+	// it in.
+	Credential azcore.TokenCredential
 }
 
 func (config *ADLv1Config) Init() {
 }
 
+// AzureAuthorizerConfig describes how to obtain an azcore.TokenCredential
+// for talking to Azure Storage. Credential() builds a DefaultAzureCredential
+// style chain: environment service principal, then workload identity, then
+// managed identity, then the Azure CLI's logged-in account.
 type AzureAuthorizerConfig struct {
 	Log      *LogHandle
 	TenantId string
+
+	Environment      AzureCloudEnvironment
+	TokenRenewBuffer time.Duration
 }
 
 var azbLog = GetLogger("azblob")
 var adls1Log = GetLogger("adlv1")
 
-func sptTest(spt *adal.ServicePrincipalToken) (autorest.Authorizer, error) {
-	err := spt.EnsureFresh()
-	if err != nil {
-		return nil, err
+// Credential returns a chained azcore.TokenCredential that tries, in order,
+// a client secret/certificate from the environment, workload identity
+// federation, managed identity, and finally the Azure CLI's cached login.
+// The first credential in the chain able to mint a token wins; later
+// credentials are only consulted once an earlier one reports it isn't
+// configured. Resolving a tenant ID from the Azure CLI's profile is only
+// attempted for the CLI credential itself, since it's the one branch that
+// needs it and the only one that assumes an `az login` has happened —
+// everything else must keep working on a CLI-less VM/AKS node.
+func (c AzureAuthorizerConfig) Credential() (azcore.TokenCredential, error) {
+	if c.Environment.ARM.ActiveDirectoryAuthorityHost == "" {
+		env, err := azureEnvironment("")
+		if err != nil {
+			return nil, err
+		}
+		c.Environment = env
 	}
 
-	return autorest.NewBearerAuthorizer(spt), nil
-}
+	if c.TenantId == "" {
+		// AZURE_TENANT_ID is how the env service principal and CLI
+		// branches learn the tenant without an `az login`; it is also the
+		// var AKS Workload Identity projects alongside
+		// AZURE_FEDERATED_TOKEN_FILE and AZURE_CLIENT_ID, which the
+		// workload identity credential reads itself.
+		c.TenantId = os.Getenv("AZURE_TENANT_ID")
+	}
 
-func tokenToAuthorizer(t *cli.Token) (autorest.Authorizer, error) {
-	u, err := url.Parse(t.Authority)
-	if err != nil {
-		return nil, err
+	var creds []azcore.TokenCredential
+
+	if cred, err := envCredential(c.TenantId, c.Environment); err == nil {
+		creds = append(creds, cred)
+	} else {
+		c.Log.Debugf("no service principal credential in environment: %v", err)
 	}
 
-	tenantId := u.Path
-	u.Path = ""
+	if cred, err := workloadIdentityCredential(c.Environment); err == nil {
+		creds = append(creds, cred)
+	} else {
+		c.Log.Debugf("no workload identity federation configured: %v", err)
+	}
 
-	oauth, err := adal.NewOAuthConfig(u.String(), tenantId)
-	if err != nil {
-		return nil, err
+	if cred, err := managedIdentityCredential(c.Environment); err == nil {
+		creds = append(creds, cred)
 	}
 
-	aToken, err := t.ToADALToken()
-	if err != nil {
-		return nil, err
+	cliTenantId := c.TenantId
+	if cliTenantId == "" {
+		if defaultSubscription, err := azureDefaultSubscription(); err == nil {
+			cliTenantId = defaultSubscription.TenantID
+		}
+	}
+	cliOpts := &azidentity.AzureCLICredentialOptions{TenantID: cliTenantId}
+	if cred, err := azidentity.NewAzureCLICredential(cliOpts); err == nil {
+		creds = append(creds, cred)
 	}
 
-	spt, err := adal.NewServicePrincipalTokenFromManualToken(*oauth, t.ClientID, t.Resource,
-		aToken)
-	if err != nil {
-		return nil, err
+	if len(creds) == 0 {
+		return nil, fmt.Errorf("unable to construct any Azure credential for tenant %v", c.TenantId)
 	}
 
-	return sptTest(spt)
+	return azidentity.NewChainedTokenCredential(creds, nil)
 }
 
-func msiToAuthorizer(mc auth.MSIConfig) (autorest.Authorizer, error) {
-	// copied from azure/auth/auth.go so we can test this Authorizer
-	msiEndpoint, err := adal.GetMSIVMEndpoint()
-	if err != nil {
-		return nil, err
+type azureCredentialCacheKey struct {
+	tenantId string
+	resource string
+	clientId string
+}
+
+type azureCredentialCacheEntry struct {
+	cred azcore.TokenCredential
+
+	mu           sync.Mutex
+	refreshCount uint64
+	lastErr      error
+	expiresOn    time.Time
+}
+
+// AzureCredentialCache shares one azcore.TokenCredential per
+// (tenantId, resource, clientId) across every backend in a mount instead
+// of having each caller re-walk the env/workload-identity/MSI/CLI chain
+// (re-parsing ~/.azure/accessTokens.json, re-hitting IMDS, ...) on every
+// auth. The first Get() for a key builds the chain and starts a
+// background goroutine that proactively refreshes the token
+// TokenRenewBuffer before it expires.
+type AzureCredentialCache struct {
+	mu      sync.Mutex
+	entries map[azureCredentialCacheKey]*azureCredentialCacheEntry
+}
+
+var azureCredCache = &AzureCredentialCache{
+	entries: make(map[azureCredentialCacheKey]*azureCredentialCacheEntry),
+}
+
+// Get returns the shared credential for (config.TenantId, resource,
+// AZURE_CLIENT_ID), building it and kicking off its refresh loop on
+// first use.
+func (c *AzureCredentialCache) Get(config AzureAuthorizerConfig, resource string) (azcore.TokenCredential, error) {
+	key := azureCredentialCacheKey{
+		tenantId: config.TenantId,
+		resource: resource,
+		clientId: os.Getenv("AZURE_CLIENT_ID"),
 	}
 
-	var spt *adal.ServicePrincipalToken
-	if mc.ClientID == "" {
-		spt, err = adal.NewServicePrincipalTokenFromMSI(msiEndpoint, mc.Resource)
-	} else {
-		spt, err = adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint, mc.Resource, mc.ClientID)
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok {
+		return entry.cred, nil
 	}
+
+	cred, err := config.Credential()
 	if err != nil {
 		return nil, err
 	}
 
-	return sptTest(spt)
+	renewBuffer := config.TokenRenewBuffer
+	if renewBuffer == 0 {
+		renewBuffer = defaultTokenRenewBuffer
+	}
+
+	entry = &azureCredentialCacheEntry{cred: cred}
+
+	c.mu.Lock()
+	if existing, ok := c.entries[key]; ok {
+		c.mu.Unlock()
+		return existing.cred, nil
+	}
+	c.entries[key] = entry
+	c.mu.Unlock()
+
+	go entry.refreshLoop(config.Log, resource, renewBuffer)
+
+	return cred, nil
 }
 
-func (c AzureAuthorizerConfig) Authorizer() (autorest.Authorizer, error) {
-	if c.TenantId == "" {
-		defaultSubscription, err := azureDefaultSubscription()
+// resourceScope turns an AAD resource/audience URI (which may or may not
+// end in "/": storageResourceID and azcore's built-in ARM audiences do,
+// AzureGermanCloud's does not) into the "/.default" scope GetToken
+// expects, without doubling up the slash.
+func resourceScope(resource string) string {
+	return strings.TrimSuffix(resource, "/") + "/.default"
+}
+
+// refreshLoop keeps the cached token warm, logging refresh count,
+// the last refresh error, and time-to-expiry through the usual logger so
+// auth failures mid-mount show up without attaching a debugger.
+func (e *azureCredentialCacheEntry) refreshLoop(log *LogHandle, resource string, renewBuffer time.Duration) {
+	for {
+		tok, err := e.cred.GetToken(context.Background(), policy.TokenRequestOptions{
+			Scopes: []string{resourceScope(resource)},
+		})
+
+		e.mu.Lock()
+		e.refreshCount++
+		e.lastErr = err
+		refreshCount := e.refreshCount
+		if err == nil {
+			e.expiresOn = tok.ExpiresOn
+		}
+		e.mu.Unlock()
+
 		if err != nil {
-			return nil, err
+			log.Errorf("azure credential refresh #%v for %v failed: %v", refreshCount, resource, err)
+			time.Sleep(renewBuffer)
+			continue
 		}
-		c.TenantId = defaultSubscription.TenantID
-	}
 
-	env, err := auth.GetSettingsFromEnvironment()
-	if err != nil {
-		return nil, err
-	}
+		log.Debugf("refreshed azure credential #%v for %v, expires %v (time-to-expiry %v)",
+			refreshCount, resource, tok.ExpiresOn, time.Until(tok.ExpiresOn))
 
-	if cred, err := env.GetClientCredentials(); err == nil {
-		if authorizer, err := cred.Authorizer(); err == nil {
-			return authorizer, err
+		sleep := time.Until(tok.ExpiresOn) - renewBuffer
+		if sleep < 0 {
+			sleep = renewBuffer
 		}
+		time.Sleep(sleep)
 	}
+}
 
-	if settings, err := auth.GetSettingsFromFile(); err == nil {
-		if authorizer, err := settings.ClientCredentialsAuthorizerWithResource(
-			auth.Resource); err == nil {
-			return authorizer, err
-		}
+// envCredential builds a client secret or client certificate credential
+// from AZURE_CLIENT_ID/AZURE_CLIENT_SECRET/AZURE_CLIENT_CERTIFICATE_PATH,
+// mirroring the service principal env vars go-autorest's auth package used
+// to read.
+func envCredential(tenantId string, env AzureCloudEnvironment) (azcore.TokenCredential, error) {
+	clientId := os.Getenv("AZURE_CLIENT_ID")
+	if clientId == "" {
+		return nil, fmt.Errorf("AZURE_CLIENT_ID not set")
 	}
 
-	if env.Values[auth.Resource] == "" {
-		env.Values[auth.Resource] = env.Environment.ResourceManagerEndpoint
-	}
-	if env.Values[auth.ActiveDirectoryEndpoint] == "" {
-		env.Values[auth.ActiveDirectoryEndpoint] = env.Environment.ActiveDirectoryEndpoint
+	if secret := os.Getenv("AZURE_CLIENT_SECRET"); secret != "" {
+		opts := &azidentity.ClientSecretCredentialOptions{
+			ClientOptions: azcore.ClientOptions{Cloud: env.ARM},
+		}
+		return azidentity.NewClientSecretCredential(tenantId, clientId, secret, opts)
 	}
-	adEndpoint := strings.Trim(env.Values[auth.ActiveDirectoryEndpoint], "/") +
-		"/" + c.TenantId
-	c.Log.Debugf("looking for access token for %v", adEndpoint)
 
-	accessTokensPath, err := cli.AccessTokensPath()
-	if err == nil {
-		accessTokens, err := cli.LoadTokens(accessTokensPath)
-		if err == nil {
-			for _, t := range accessTokens {
-				if t.Authority == adEndpoint {
-					c.Log.Debugf("found token for %v %v", t.Resource, t.Authority)
-					var authorizer autorest.Authorizer
-					authorizer, err = tokenToAuthorizer(&t)
-					if err == nil {
-						return authorizer, nil
-					}
-				}
-			}
+	if certPath := os.Getenv("AZURE_CLIENT_CERTIFICATE_PATH"); certPath != "" {
+		data, err := os.ReadFile(certPath)
+		if err != nil {
+			return nil, err
 		}
+		password := []byte(os.Getenv("AZURE_CLIENT_CERTIFICATE_PASSWORD"))
+		certs, key, err := azidentity.ParseCertificates(data, password)
 		if err != nil {
 			return nil, err
 		}
+		opts := &azidentity.ClientCertificateCredentialOptions{
+			ClientOptions: azcore.ClientOptions{Cloud: env.ARM},
+		}
+		return azidentity.NewClientCertificateCredential(tenantId, clientId, certs, key, opts)
 	}
 
-	c.Log.Debug("falling back to MSI")
-	return msiToAuthorizer(env.GetMSI())
+	return nil, fmt.Errorf("neither AZURE_CLIENT_SECRET nor AZURE_CLIENT_CERTIFICATE_PATH set")
+}
+
+// managedIdentityID picks which user-assigned identity to pin a managed
+// identity credential to, preferring AZURE_MSI_RESOURCE_ID over
+// AZURE_MSI_OBJECT_ID over AZURE_CLIENT_ID (resource ID is unambiguous
+// across subscriptions, unlike the other two). Returns nil, selecting the
+// system-assigned identity, when none are set.
+func managedIdentityID() azidentity.ManagedIDKind {
+	switch {
+	case os.Getenv("AZURE_MSI_RESOURCE_ID") != "":
+		return azidentity.ResourceID(os.Getenv("AZURE_MSI_RESOURCE_ID"))
+	case os.Getenv("AZURE_MSI_OBJECT_ID") != "":
+		return azidentity.ObjectID(os.Getenv("AZURE_MSI_OBJECT_ID"))
+	case os.Getenv("AZURE_CLIENT_ID") != "":
+		return azidentity.ClientID(os.Getenv("AZURE_CLIENT_ID"))
+	}
+
+	return nil
+}
+
+// managedIdentityCredential builds a managed identity credential, pinning
+// it to a specific user-assigned identity when AZURE_CLIENT_ID,
+// AZURE_MSI_RESOURCE_ID, or AZURE_MSI_OBJECT_ID is set. This lets a
+// VM/AKS node with several identities attached pick one without touching
+// ~/.azure. With none of these set, it falls back to the system-assigned
+// identity.
+func managedIdentityCredential(env AzureCloudEnvironment) (azcore.TokenCredential, error) {
+	opts := &azidentity.ManagedIdentityCredentialOptions{
+		ClientOptions: azcore.ClientOptions{Cloud: env.ARM},
+		ID:            managedIdentityID(),
+	}
+
+	return azidentity.NewManagedIdentityCredential(opts)
+}
+
+// workloadIdentityCredential builds a credential for the AKS Azure AD
+// Workload Identity flow: it exchanges the projected service-account JWT at
+// AZURE_FEDERATED_TOKEN_FILE for a storage bearer token via the
+// client_assertion_type=urn:ietf:params:oauth:client-assertion-type:jwt-bearer
+// grant. azidentity re-reads the token file on every refresh, which is
+// required since kubelet rotates it roughly hourly. AZURE_AUTHORITY_HOST,
+// when set, picks the AAD endpoint to exchange against.
+func workloadIdentityCredential(env AzureCloudEnvironment) (azcore.TokenCredential, error) {
+	if os.Getenv("AZURE_FEDERATED_TOKEN_FILE") == "" {
+		return nil, fmt.Errorf("AZURE_FEDERATED_TOKEN_FILE not set")
+	}
+
+	cloudConfig := env.ARM
+	if authorityHost := os.Getenv("AZURE_AUTHORITY_HOST"); authorityHost != "" {
+		cloudConfig.ActiveDirectoryAuthorityHost = authorityHost
+	}
+
+	opts := &azidentity.WorkloadIdentityCredentialOptions{
+		ClientOptions: azcore.ClientOptions{Cloud: cloudConfig},
+	}
+	return azidentity.NewWorkloadIdentityCredential(opts)
 }
 
 func azureDefaultSubscription() (*cli.Subscription, error) {
@@ -204,53 +516,139 @@ func azureDefaultSubscription() (*cli.Subscription, error) {
 	return nil, fmt.Errorf("Unable to find default azure subscription id")
 }
 
-func azureAccountsClient(account string) (azblob.AccountsClient, error) {
-	var c azblob.AccountsClient
-
-	defaultSubscription, err := azureDefaultSubscription()
+func azureAccountsClient(subscriptionId string, cred azcore.TokenCredential, env AzureCloudEnvironment) (*armstorage.AccountsClient, error) {
+	opts := &arm.ClientOptions{ClientOptions: azcore.ClientOptions{Cloud: env.ARM}}
+	clientFactory, err := armstorage.NewClientFactory(subscriptionId, cred, opts)
 	if err != nil {
-		return c, err
-	}
-
-	c = azblob.NewAccountsClient(defaultSubscription.ID)
-
-	authorizer, err := AzureAuthorizerConfig{
-		Log:      azbLog,
-		TenantId: defaultSubscription.TenantID,
-	}.Authorizer()
-	if err != nil {
-		return c, err
+		return nil, err
 	}
 
-	c.BaseClient.Authorizer = authorizer
-	return c, nil
+	return clientFactory.NewAccountsClient(), nil
 }
 
-func azureFindAccount(client azblob.AccountsClient, account string) (string, string, error) {
-	accountsRes, err := client.List(context.TODO())
-	if err != nil {
-		return "", "", err
-	}
+func azureFindAccount(client *armstorage.AccountsClient, account string) (string, string, error) {
+	pager := client.NewListPager(nil)
+	for pager.More() {
+		page, err := pager.NextPage(context.TODO())
+		if err != nil {
+			return "", "", err
+		}
+
+		for _, acc := range page.Value {
+			if acc.Name == nil || *acc.Name != account {
+				continue
+			}
+			if acc.ID == nil {
+				return "", "", fmt.Errorf("Azure account %v has no id", account)
+			}
+			if acc.Properties == nil || acc.Properties.PrimaryEndpoints == nil ||
+				acc.Properties.PrimaryEndpoints.Blob == nil {
+				return "", "", fmt.Errorf("Azure account %v has no blob endpoint "+
+					"(account may still be provisioning)", account)
+			}
 
-	for _, acc := range *accountsRes.Value {
-		if *acc.Name == account {
 			// /subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/...
 			parts := strings.SplitN(*acc.ID, "/", 6)
 			if len(parts) != 6 {
 				return "", "", fmt.Errorf("Malformed account id: %v", *acc.ID)
 			}
-			return *acc.PrimaryEndpoints.Blob, parts[4], nil
+			return *acc.Properties.PrimaryEndpoints.Blob, parts[4], nil
 		}
 	}
 
 	return "", "", fmt.Errorf("Azure account not found: %v", account)
 }
 
-func AzureBlobConfig(endpoint string, wasb string) (config AZBlobConfig, err error) {
+// sasTokenProvider returns a SASTokenProvider that serves sasToken as-is,
+// or, when renewCommand is non-empty, re-runs renewCommand to fetch a
+// fresh token. The backend consults TokenRenewBuffer to decide when a
+// renewal is due, so long-running mounts can rotate a SAS without a
+// remount.
+func sasTokenProvider(sasToken string, renewCommand string) SASTokenProvider {
+	return func() (string, error) {
+		if renewCommand == "" {
+			return sasToken, nil
+		}
+
+		out, err := exec.Command("sh", "-c", renewCommand).Output()
+		if err != nil {
+			return "", fmt.Errorf("SAS renewal command failed: %v", err)
+		}
+
+		return strings.TrimSpace(string(out)), nil
+	}
+}
+
+// sasTokenFromURL splits a full blob URL containing a SAS query string
+// (https://account.blob.core.windows.net/container/prefix?sv=...) into
+// its endpoint, container, prefix and raw query components, so users can
+// pass AZURE_STORAGE_SAS_TOKEN as either a bare query string or a
+// complete URL copy-pasted from the Azure portal.
+func sasTokenFromURL(sasToken string) (endpoint, container, prefix, query string, err error) {
+	u, err := url.Parse(sasToken)
+	if err != nil || u.Host == "" || u.RawQuery == "" {
+		return "", "", "", "", fmt.Errorf("not a full SAS URL")
+	}
+
+	endpoint = u.Scheme + "://" + u.Host + "/"
+	path := strings.Trim(u.Path, "/")
+	parts := strings.SplitN(path, "/", 2)
+	container = parts[0]
+	if len(parts) == 2 {
+		prefix = parts[1]
+	}
+
+	return endpoint, container, prefix, u.RawQuery, nil
+}
+
+func AzureBlobConfig(endpoint string, wasb string, sasToken string, cloudName string) (config AZBlobConfig, err error) {
 	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
 	key := os.Getenv("AZURE_STORAGE_KEY")
 	configDir := os.Getenv("AZURE_CONFIG_DIR")
 
+	env, err := azureEnvironment(cloudName)
+	if err != nil {
+		return
+	}
+
+	if sasToken == "" {
+		sasToken = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+
+	if sasToken != "" {
+		config.Init()
+
+		if sasEndpoint, sasContainer, sasPrefix, query, urlErr := sasTokenFromURL(sasToken); urlErr == nil {
+			endpoint = sasEndpoint
+			config.Container = sasContainer
+			config.Prefix = sasPrefix
+			sasToken = query
+		} else {
+			// Not a full URL. The Azure Portal's "SAS token" field is a
+			// bare query string with a leading "?" (e.g. "?sv=...&sig=...");
+			// strip it so it isn't re-prepended when building requests.
+			sasToken = strings.TrimPrefix(sasToken, "?")
+		}
+
+		if endpoint == "" {
+			if account == "" {
+				err = fmt.Errorf("Missing account: configure via AZURE_STORAGE_ACCOUNT " +
+					"or pass a full SAS URL")
+				return
+			}
+			endpoint = "https://" + account + ".blob." + env.StorageEndpointSuffix
+		}
+
+		config.Endpoint = endpoint
+		config.AccountName = account
+		// SAS auth is a management-plane bypass: the caller's AAD
+		// principal may not have Microsoft.Storage/*/listKeys/action,
+		// so skip ListKeys entirely.
+		config.SasToken = sasTokenProvider(sasToken, os.Getenv("AZURE_STORAGE_SAS_RENEW_COMMAND"))
+
+		return
+	}
+
 	// check if the wasb url contains the storage endpoint
 	at := strings.Index(wasb, "@")
 	if at != -1 {
@@ -306,8 +704,24 @@ func AzureBlobConfig(endpoint string, wasb string) (config AZBlobConfig, err err
 	}
 
 	if endpoint == "" || key == "" {
-		var client azblob.AccountsClient
-		client, err = azureAccountsClient(account)
+		var defaultSubscription *cli.Subscription
+		defaultSubscription, err = azureDefaultSubscription()
+		if err != nil {
+			return
+		}
+
+		var cred azcore.TokenCredential
+		cred, err = azureCredCache.Get(AzureAuthorizerConfig{
+			Log:         azbLog,
+			TenantId:    defaultSubscription.TenantID,
+			Environment: env,
+		}, env.ARM.Services[cloud.ResourceManager].Audience)
+		if err != nil {
+			return
+		}
+
+		var client *armstorage.AccountsClient
+		client, err = azureAccountsClient(defaultSubscription.ID, cred, env)
 		if err == nil {
 			var resourceGroup string
 			endpoint, resourceGroup, err = azureFindAccount(client, account)
@@ -321,23 +735,43 @@ func AzureBlobConfig(endpoint string, wasb string) (config AZBlobConfig, err err
 			azbLog.Debugf("Using detected account endpoint: %v", endpoint)
 
 			if key == "" {
-				var keysRes azblob.AccountListKeysResult
-				keysRes, err = client.ListKeys(context.TODO(), resourceGroup, account)
-				if err != nil || len(*keysRes.Keys) == 0 {
-					err = fmt.Errorf("Missing key: configure via AZURE_STORAGE_KEY "+
-						"or %v/config", configDir)
+				keysRes, listErr := client.ListKeys(context.TODO(), resourceGroup, account, nil)
+				if listErr != nil || len(keysRes.Keys) == 0 {
+					// The caller's AAD principal may have data-plane
+					// RBAC (e.g. Storage Blob Data Reader) without
+					// Microsoft.Storage/*/listKeys/action. Hand the
+					// backend a cached bearer-token credential for the
+					// storage data plane instead of an account key.
+					azbLog.Debugf("Unable to list keys for %v (%v), falling back to AAD credential",
+						account, listErr)
+					config.Credential, err = azureCredCache.Get(AzureAuthorizerConfig{
+						Log:         azbLog,
+						TenantId:    defaultSubscription.TenantID,
+						Environment: env,
+					}, storageResourceID)
+					if err != nil {
+						err = fmt.Errorf("Missing key: configure via AZURE_STORAGE_KEY "+
+							"or %v/config, and no usable AAD credential either: %v", configDir, err)
+						return
+					}
+
+					config.Init()
+					config.Endpoint = endpoint
+					config.AccountName = account
 					return
 				}
 
 				// prefer full permission keys
-				for _, k := range *keysRes.Keys {
-					if k.Permissions == azblob.Full {
+				for _, k := range keysRes.Keys {
+					if *k.Permissions == armstorage.KeyPermissionFull {
 						key = *k.Value
 						break
 					}
 				}
 				// if not just take the first one
-				key = *(*keysRes.Keys)[0].Value
+				if key == "" {
+					key = *keysRes.Keys[0].Value
+				}
 			}
 		} else {
 			return
@@ -345,8 +779,7 @@ func AzureBlobConfig(endpoint string, wasb string) (config AZBlobConfig, err err
 	}
 
 	if endpoint == "" {
-		endpoint = "https://" + account + ".blob." +
-			azure.PublicCloud.StorageEndpointSuffix
+		endpoint = "https://" + account + ".blob." + env.StorageEndpointSuffix
 		azbLog.Debugf("Unable to detect endpoint for account %v, using %v",
 			account, endpoint)
 	}
@@ -0,0 +1,299 @@
+// Copyright 2019 Databricks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+func TestAzureEnvironment(t *testing.T) {
+	tests := []struct {
+		name       string
+		cloudName  string
+		envVar     string
+		wantName   string
+		wantSuffix string
+	}{
+		{"defaults to public cloud", "", "", "AzurePublicCloud", "core.windows.net"},
+		{"explicit public cloud", AzurePublicCloud.Name, "", "AzurePublicCloud", "core.windows.net"},
+		{"explicit government cloud", AzureUSGovernmentCloud.Name, "", "AzureUSGovernmentCloud", "core.usgovcloudapi.net"},
+		{"explicit china cloud", AzureChinaCloud.Name, "", "AzureChinaCloud", "core.chinacloudapi.cn"},
+		{"explicit german cloud", AzureGermanCloud.Name, "", "AzureGermanCloud", "core.cloudapi.de"},
+		{"falls back to AZURE_ENVIRONMENT", "", AzureChinaCloud.Name, "AzureChinaCloud", "core.chinacloudapi.cn"},
+		{"explicit arg wins over AZURE_ENVIRONMENT", AzureUSGovernmentCloud.Name, AzureChinaCloud.Name, "AzureUSGovernmentCloud", "core.usgovcloudapi.net"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setOrUnset(t, "AZURE_ENVIRONMENT", tt.envVar)
+			defer os.Unsetenv("AZURE_ENVIRONMENT")
+
+			env, err := azureEnvironment(tt.cloudName)
+			if err != nil {
+				t.Fatalf("azureEnvironment(%q) returned error: %v", tt.cloudName, err)
+			}
+			if env.Name != tt.wantName || env.StorageEndpointSuffix != tt.wantSuffix {
+				t.Errorf("azureEnvironment(%q) = %+v, want name=%v suffix=%v",
+					tt.cloudName, env, tt.wantName, tt.wantSuffix)
+			}
+		})
+	}
+
+	if _, err := azureEnvironment("NotACloud"); err == nil {
+		t.Error("azureEnvironment(\"NotACloud\") succeeded, want error")
+	}
+}
+
+func TestAzureStackEnvironment(t *testing.T) {
+	const metadata = `{
+		"authentication": {
+			"loginEndpoint": "https://login.stack.example.com/",
+			"audiences": ["https://management.stack.example.com/"]
+		},
+		"suffixes": {
+			"storage": "blob.stack.example.com"
+		}
+	}`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, metadata)
+	}))
+	defer server.Close()
+
+	env, err := azureStackEnvironment(server.URL)
+	if err != nil {
+		t.Fatalf("azureStackEnvironment returned error: %v", err)
+	}
+	if env.StorageEndpointSuffix != "blob.stack.example.com" {
+		t.Errorf("StorageEndpointSuffix = %v, want blob.stack.example.com", env.StorageEndpointSuffix)
+	}
+	if env.ARM.ActiveDirectoryAuthorityHost != "https://login.stack.example.com/" {
+		t.Errorf("ActiveDirectoryAuthorityHost = %v, want https://login.stack.example.com/",
+			env.ARM.ActiveDirectoryAuthorityHost)
+	}
+	if got := env.ARM.Services[cloud.ResourceManager].Audience; got != "https://management.stack.example.com/" {
+		t.Errorf("Audience = %v, want https://management.stack.example.com/", got)
+	}
+}
+
+func TestSasTokenFromURL(t *testing.T) {
+	tests := []struct {
+		name          string
+		in            string
+		wantErr       bool
+		wantEndpoint  string
+		wantContainer string
+		wantPrefix    string
+		wantQuery     string
+	}{
+		{
+			name:          "full url with container and prefix",
+			in:            "https://account.blob.core.windows.net/container/some/prefix?sv=2022-01-01&sig=abc",
+			wantEndpoint:  "https://account.blob.core.windows.net/",
+			wantContainer: "container",
+			wantPrefix:    "some/prefix",
+			wantQuery:     "sv=2022-01-01&sig=abc",
+		},
+		{
+			name:          "full url with container only",
+			in:            "https://account.blob.core.windows.net/container?sv=2022-01-01&sig=abc",
+			wantEndpoint:  "https://account.blob.core.windows.net/",
+			wantContainer: "container",
+			wantPrefix:    "",
+			wantQuery:     "sv=2022-01-01&sig=abc",
+		},
+		{
+			name:    "bare query string has no host",
+			in:      "sv=2022-01-01&sig=abc",
+			wantErr: true,
+		},
+		{
+			name:    "portal-style token with leading ? has no host",
+			in:      "?sv=2022-01-01&sig=abc",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint, container, prefix, query, err := sasTokenFromURL(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("sasTokenFromURL(%q) succeeded, want error", tt.in)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sasTokenFromURL(%q) returned error: %v", tt.in, err)
+			}
+			if endpoint != tt.wantEndpoint || container != tt.wantContainer ||
+				prefix != tt.wantPrefix || query != tt.wantQuery {
+				t.Errorf("sasTokenFromURL(%q) = (%v, %v, %v, %v), want (%v, %v, %v, %v)",
+					tt.in, endpoint, container, prefix, query,
+					tt.wantEndpoint, tt.wantContainer, tt.wantPrefix, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestManagedIdentityID(t *testing.T) {
+	tests := []struct {
+		name       string
+		resourceId string
+		objectId   string
+		clientId   string
+		want       azidentity.ManagedIDKind
+	}{
+		{"none set selects system-assigned identity", "", "", "", nil},
+		{"client id only", "", "", "client-1", azidentity.ClientID("client-1")},
+		{"object id only", "", "object-1", "", azidentity.ObjectID("object-1")},
+		{"resource id only", "resource-1", "", "", azidentity.ResourceID("resource-1")},
+		{"resource id wins over object id", "resource-1", "object-1", "", azidentity.ResourceID("resource-1")},
+		{"resource id wins over client id", "resource-1", "", "client-1", azidentity.ResourceID("resource-1")},
+		{"object id wins over client id", "", "object-1", "client-1", azidentity.ObjectID("object-1")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setOrUnset(t, "AZURE_MSI_RESOURCE_ID", tt.resourceId)
+			setOrUnset(t, "AZURE_MSI_OBJECT_ID", tt.objectId)
+			setOrUnset(t, "AZURE_CLIENT_ID", tt.clientId)
+			defer os.Unsetenv("AZURE_MSI_RESOURCE_ID")
+			defer os.Unsetenv("AZURE_MSI_OBJECT_ID")
+			defer os.Unsetenv("AZURE_CLIENT_ID")
+
+			got := managedIdentityID()
+			if got != tt.want {
+				t.Errorf("managedIdentityID() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func setOrUnset(t *testing.T, name, value string) {
+	t.Helper()
+	if value == "" {
+		os.Unsetenv(name)
+		return
+	}
+	os.Setenv(name, value)
+}
+
+func TestResourceScope(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource string
+		want     string
+	}{
+		{"slash-terminated resource", "https://storage.azure.com/", "https://storage.azure.com/.default"},
+		{"bare resource", "https://storage.azure.com", "https://storage.azure.com/.default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resourceScope(tt.resource); got != tt.want {
+				t.Errorf("resourceScope(%q) = %q, want %q", tt.resource, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeCredential records the scopes GetToken was called with, so tests can
+// assert on what refreshLoop/Get actually ask AAD for without a real IMDS
+// or AAD endpoint.
+type fakeCredential struct {
+	scopes chan []string
+}
+
+func (f *fakeCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	f.scopes <- opts.Scopes
+	return azcore.AccessToken{Token: "fake-token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// TestRefreshLoopScope exercises AzureCredentialCache's background refresh
+// path end-to-end with a fake credential: resource strings passed to Get()
+// (storageResourceID, most ARM audiences) are slash-terminated, and refreshLoop
+// must not double that slash up when building the GetToken scope.
+func TestRefreshLoopScope(t *testing.T) {
+	fake := &fakeCredential{scopes: make(chan []string, 1)}
+	entry := &azureCredentialCacheEntry{cred: fake}
+
+	go entry.refreshLoop(azbLog, storageResourceID, time.Hour)
+
+	select {
+	case scopes := <-fake.scopes:
+		if len(scopes) != 1 || scopes[0] != "https://storage.azure.com/.default" {
+			t.Errorf("refreshLoop called GetToken with scopes %v, want [https://storage.azure.com/.default]", scopes)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("refreshLoop never called GetToken")
+	}
+}
+
+// TestAzureCredentialCacheDedupesOnRace exercises the double-checked-locking
+// in AzureCredentialCache.Get: many concurrent first-time Get()s for the
+// same (tenantId, resource, clientId) key must all resolve to the one
+// credential instance that wins the race, not one each.
+func TestAzureCredentialCacheDedupesOnRace(t *testing.T) {
+	c := &AzureCredentialCache{entries: make(map[azureCredentialCacheKey]*azureCredentialCacheEntry)}
+	config := AzureAuthorizerConfig{Log: azbLog, TenantId: "test-tenant", Environment: AzurePublicCloud}
+
+	const n = 16
+	var wg sync.WaitGroup
+	results := make([]interface{}, n)
+	errs := make([]error, n)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cred, err := c.Get(config, "https://storage.azure.com/")
+			results[i] = cred
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Get() call %v returned error: %v", i, err)
+		}
+	}
+	for i := 1; i < n; i++ {
+		if results[i] != results[0] {
+			t.Errorf("Get() call %v returned a different credential instance than call 0; "+
+				"concurrent Get()s for the same key should dedup to one", i)
+		}
+	}
+
+	c.mu.Lock()
+	numEntries := len(c.entries)
+	c.mu.Unlock()
+	if numEntries != 1 {
+		t.Errorf("cache has %v entries after %v concurrent Get()s for one key, want 1", numEntries, n)
+	}
+}